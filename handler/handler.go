@@ -2,21 +2,22 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"sort"
 	"strings"
-
-	"golang.org/x/net/context"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/camptocamp/bivac/pkg/engine"
+	"github.com/camptocamp/bivac/pkg/event"
+	"github.com/camptocamp/bivac/pkg/idle"
 	"github.com/camptocamp/conplicity/util"
-	docker "github.com/docker/engine-api/client"
-	"github.com/docker/engine-api/types"
-	"github.com/docker/engine-api/types/container"
 	"github.com/jessevdk/go-flags"
 )
 
@@ -28,6 +29,7 @@ type config struct {
 	Manpage          bool     `short:"m" long:"manpage" description:"Output manpage."`
 	NoVerify         bool     `long:"no-verify" description:"Do not verify backup." env:"CONPLICITY_NO_VERIFY"`
 	JSON             bool     `short:"j" long:"json" description:"Log as JSON (to stderr)." env:"JSON_OUTPUT"`
+	Engine           string   `long:"engine" description:"Backup engine to use: 'docker', 'podman' or 'runc'." env:"BIVAC_ENGINE" default:"docker"`
 
 	Duplicity struct {
 		TargetURL       string `short:"u" long:"url" description:"The duplicity target URL to push to." env:"DUPLICITY_TARGET_URL"`
@@ -55,14 +57,24 @@ type config struct {
 	Docker struct {
 		Endpoint string `short:"e" long:"docker-endpoint" description:"The Docker endpoint." env:"DOCKER_ENDPOINT" default:"unix:///var/run/docker.sock"`
 	} `group:"Docker Options"`
+
+	Server struct {
+		IdleTimeout string `long:"idle-timeout" description:"Shut the server down once idle (no in-flight requests or backups) for this long (e.g. '5m'). Empty disables idle shutdown." env:"BIVAC_IDLE_TIMEOUT"`
+	} `group:"Server Options"`
 }
 
 // Conplicity is the main handler struct
 type Conplicity struct {
-	*docker.Client
 	Config   *config
 	Hostname string
 	Metrics  []string
+	Events   *event.Bus
+	// Idle tracks in-flight backups so a running server doesn't shut
+	// itself down mid-backup. It is nil when running as a one-shot CLI.
+	Idle *idle.Tracker
+	// Engine runs the duplicity image for LaunchDuplicity, selected by
+	// Config.Engine.
+	Engine engine.Engine
 }
 
 // Setup sets up a Conplicity struct
@@ -75,10 +87,12 @@ func (c *Conplicity) Setup(version string) (err error) {
 	c.Hostname, err = os.Hostname()
 	util.CheckErr(err, "Failed to get hostname: %v", "panic")
 
-	c.Client, err = docker.NewClient(c.Config.Docker.Endpoint, "", nil, nil)
-	util.CheckErr(err, "Failed to create Docker client: %v", "panic")
+	c.Events = event.NewBus()
+
+	c.Engine, err = engine.New(c.Config.Engine, c.Config.Docker.Endpoint)
+	util.CheckErr(err, "Failed to set up backup engine: %v", "panic")
 
-	err = c.pullImage()
+	err = c.Engine.Pull(context.Background(), c.Config.Image)
 	util.CheckErr(err, "Failed to pull image: %v", "panic")
 
 	return
@@ -133,25 +147,10 @@ func (c *Conplicity) setupLoglevel() (err error) {
 	return
 }
 
-func (c *Conplicity) pullImage() (err error) {
-	if _, _, err = c.ImageInspectWithRaw(context.Background(), c.Config.Image, false); err != nil {
-		// TODO: output pull to logs
-		log.WithFields(log.Fields{
-			"image": c.Config.Image,
-		}).Info("Pulling image")
-		_, err = c.Client.ImagePull(context.Background(), c.Config.Image, types.ImagePullOptions{})
-	} else {
-		log.WithFields(log.Fields{
-			"image": c.Config.Image,
-		}).Debug("Image already pulled, not pulling")
-	}
-
-	return
-}
-
-// LaunchDuplicity starts a duplicity container with given command and binds
-func (c *Conplicity) LaunchDuplicity(cmd []string, binds []string) (state int, stdout string, err error) {
-	env := []string{
+// duplicityEnv builds the environment variables passed to the duplicity
+// container for the configured backend.
+func (c *Conplicity) duplicityEnv() []string {
+	return []string{
 		"AWS_ACCESS_KEY_ID=" + c.Config.AWS.AccessKeyID,
 		"AWS_SECRET_ACCESS_KEY=" + c.Config.AWS.SecretAccessKey,
 		"SWIFT_USERNAME=" + c.Config.Swift.Username,
@@ -161,61 +160,91 @@ func (c *Conplicity) LaunchDuplicity(cmd []string, binds []string) (state int, s
 		"SWIFT_REGIONNAME=" + c.Config.Swift.RegionName,
 		"SWIFT_AUTHVERSION=2",
 	}
+}
 
-	log.WithFields(log.Fields{
-		"image":       c.Config.Image,
-		"command":     strings.Join(cmd, " "),
-		"environment": strings.Join(env, ", "),
-	}).Debug("Creating container")
-
-	container, err := c.ContainerCreate(
-		context.Background(),
-		&container.Config{
-			Cmd:          cmd,
-			Env:          env,
-			Image:        c.Config.Image,
-			OpenStdin:    true,
-			StdinOnce:    true,
-			AttachStdin:  true,
-			AttachStdout: true,
-			AttachStderr: true,
-			Tty:          true,
-		},
-		&container.HostConfig{
-			Binds: binds,
-		}, nil, "",
-	)
-	util.CheckErr(err, "Failed to create container: %v", "fatal")
-	defer c.removeContainer(container.ID)
-
-	log.Debugf("Launching 'duplicity %v'...", strings.Join(cmd, " "))
-	err = c.ContainerStart(context.Background(), container.ID, types.ContainerStartOptions{})
-	util.CheckErr(err, "Failed to start container: %v", "fatal")
-
-	body, err := c.ContainerLogs(context.Background(), container.ID, types.ContainerLogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Details:    true,
-		Follow:     true,
-	})
-	util.CheckErr(err, "Failed to retrieve logs: %v", "error")
-
-	defer body.Close()
-	content, err := ioutil.ReadAll(body)
-	util.CheckErr(err, "Failed to read logs from response: %v", "error")
+// BackupCommand builds the duplicity command and container binds needed to
+// back up the given volume against the configured target URL.
+func (c *Conplicity) BackupCommand(volumeName string) (cmd []string, binds []string) {
+	cmd = []string{
+		"duplicity",
+		"--full-if-older-than", c.Config.Duplicity.FullIfOlderThan,
+		"/var/lib/duplicity/data",
+		c.Config.Duplicity.TargetURL + "/" + volumeName,
+	}
+	binds = []string{volumeName + ":/var/lib/duplicity/data:ro"}
+	return
+}
 
-	stdout = string(content)
+// LaunchDuplicity starts a duplicity container for volumeName with the
+// given command and binds, and publishes a backup lifecycle Event on
+// c.Events once it starts and once it completes. If out is non-nil, it
+// receives a live copy of the backup's combined stdout/stderr as it runs
+// (see engine.RunSpec.Output); pass nil for the normal scheduled-backup
+// path.
+func (c *Conplicity) LaunchDuplicity(volumeName string, cmd []string, binds []string, out io.Writer) (state int, stdout string, err error) {
+	if c.Idle != nil {
+		c.Idle.Add()
+		defer c.Idle.Done()
+	}
 
-	cont, err := c.ContainerInspect(context.Background(), container.ID)
-	util.CheckErr(err, "Failed to inspect container: %v", "error")
+	start := time.Now()
+	c.publishEvent(event.TypeBackupStarted, volumeName, 0, 0, nil)
 
-	state = cont.State.ExitCode
+	log.WithFields(log.Fields{
+		"image":   c.Config.Image,
+		"command": strings.Join(cmd, " "),
+		"engine":  c.Config.Engine,
+	}).Debugf("Launching 'duplicity %v'...", strings.Join(cmd, " "))
+
+	var logs io.ReadCloser
+	state, logs, err = c.Engine.Run(context.Background(), engine.RunSpec{
+		Image:  c.Config.Image,
+		Cmd:    cmd,
+		Env:    c.duplicityEnv(),
+		Binds:  binds,
+		Output: out,
+	})
+	util.CheckErr(err, "Failed to run duplicity: %v", "error")
+	if logs != nil {
+		defer logs.Close()
+		content, readErr := ioutil.ReadAll(logs)
+		if readErr != nil && err == nil {
+			err = fmt.Errorf("failed to read logs: %s", readErr)
+		}
+		stdout = string(content)
+	}
 
 	log.Debug(stdout)
 
+	duration := time.Since(start)
+	if err != nil || state != 0 {
+		c.publishEvent(event.TypeBackupFailed, volumeName, state, duration, err)
+	} else {
+		c.publishEvent(event.TypeBackupFinished, volumeName, state, duration, nil)
+	}
+
 	return
 }
 
+// publishEvent publishes a backup lifecycle Event on c.Events, if set.
+func (c *Conplicity) publishEvent(typ event.Type, volumeName string, exitCode int, duration time.Duration, err error) {
+	if c.Events == nil {
+		return
+	}
+	e := event.Event{
+		Type:     typ,
+		Volume:   volumeName,
+		Hostname: c.Hostname,
+		ExitCode: exitCode,
+		Duration: duration,
+		Time:     time.Now(),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	c.Events.Publish(e)
+}
+
 // PushToPrometheus sends metrics to a Prometheus push gateway
 func (c *Conplicity) PushToPrometheus() (err error) {
 	if len(c.Metrics) == 0 || c.Config.Metrics.PushgatewayURL == "" {
@@ -242,14 +271,3 @@ func (c *Conplicity) PushToPrometheus() (err error) {
 
 	return
 }
-
-func (c *Conplicity) removeContainer(id string) {
-	log.WithFields(log.Fields{
-		"container": id,
-	}).Infof("Removing container")
-	c.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{
-		Force:         true,
-		RemoveVolumes: true,
-		RemoveLinks:   true,
-	})
-}
@@ -0,0 +1,59 @@
+// Package apierror defines the JSON error envelope returned by the Bivac
+// server for non-200 responses, and the typed errors the client unmarshals
+// it into.
+package apierror
+
+import "fmt"
+
+// Well-known error codes carried in a Response's Code field.
+const (
+	CodeVolumeNotFound   = "volume_not_found"
+	CodeUnauthorized     = "unauthorized"
+	CodeBackupInProgress = "backup_in_progress"
+	CodeInternal         = "internal"
+)
+
+// Response is the JSON envelope returned by the Bivac server for any
+// non-200 response.
+type Response struct {
+	Code         string `json:"code"`
+	Message      string `json:"message"`
+	Cause        string `json:"cause,omitempty"`
+	ResponseCode int    `json:"response_code"`
+}
+
+// NewResponse builds a Response for the given HTTP status code, apierror
+// code and message.
+func NewResponse(responseCode int, code, message string) *Response {
+	return &Response{Code: code, Message: message, ResponseCode: responseCode}
+}
+
+// WithCause attaches err's message as Cause and returns r for chaining.
+func (r *Response) WithCause(err error) *Response {
+	if err != nil {
+		r.Cause = err.Error()
+	}
+	return r
+}
+
+// Error implements the error interface.
+func (r *Response) Error() string {
+	return fmt.Sprintf("[%d %s] %s", r.ResponseCode, r.Code, r.Message)
+}
+
+// Is reports whether target is a *Response with the same Code, so that
+// callers can write errors.Is(err, apierror.ErrVolumeNotFound).
+func (r *Response) Is(target error) bool {
+	t, ok := target.(*Response)
+	if !ok {
+		return false
+	}
+	return r.Code == t.Code
+}
+
+// Sentinel errors matching the codes above, for use with errors.Is/As.
+var (
+	ErrVolumeNotFound   = &Response{Code: CodeVolumeNotFound}
+	ErrUnauthorized     = &Response{Code: CodeUnauthorized}
+	ErrBackupInProgress = &Response{Code: CodeBackupInProgress}
+)
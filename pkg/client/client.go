@@ -1,40 +1,101 @@
 package client
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/camptocamp/bivac/pkg/apierror"
+	"github.com/camptocamp/bivac/pkg/event"
 	"github.com/camptocamp/bivac/pkg/volume"
 )
 
+// clientAPIVersion is the Bivac client/server protocol version this client
+// speaks. NewClient rejects servers whose major version differs, so future
+// protocol changes can be rolled out safely.
+const clientAPIVersion = "1.2"
+
 type Client struct {
 	remoteAddress string
 	psk           string
+
+	// httpClient is used for short request/response calls and carries a
+	// fixed timeout. httpStreamClient shares its Transport (so TCP
+	// connections and TLS sessions are reused across calls) but has no
+	// timeout, since backup and event streams are long-lived.
+	httpClient       *http.Client
+	httpStreamClient *http.Client
+
+	// retryer controls retry behaviour for transient failures on
+	// newRequest. Callers may replace it with their own policy.
+	retryer Retryer
 }
 
 func NewClient(remoteAddress string, psk string) (c *Client, err error) {
+	transport := &http.Transport{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
 	c = &Client{
-		remoteAddress: remoteAddress,
-		psk:           psk,
+		remoteAddress:    remoteAddress,
+		psk:              psk,
+		httpClient:       &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		httpStreamClient: &http.Client{Transport: transport, Timeout: 0},
+		retryer:          NewExponentialBackoffRetryer(),
 	}
 
-	var pingResponse map[string]string
-	err = c.newRequest(&pingResponse, "GET", "/ping")
+	var pingResponse map[string]interface{}
+	err = c.newRequest(context.Background(), &pingResponse, "GET", "/ping")
 	if err != nil {
 		err = fmt.Errorf("failed to connect to the remote Bivac instance: %s", err)
 		return
 	}
-	if pingResponse["type"] != "pong" {
+	if typ, _ := pingResponse["type"].(string); typ != "pong" {
 		err = fmt.Errorf("wrong response from the Bivac instance: %v", pingResponse)
 		return
 	}
+
+	if serverAPIVersion, ok := pingResponse["api_version"].(string); ok && serverAPIVersion != "" {
+		if err = checkAPIVersion(serverAPIVersion); err != nil {
+			c = nil
+			return
+		}
+	}
 	return
 }
 
+// checkAPIVersion returns an error if serverAPIVersion's major component
+// doesn't match clientAPIVersion's.
+func checkAPIVersion(serverAPIVersion string) error {
+	clientMajor := strings.SplitN(clientAPIVersion, ".", 2)[0]
+	serverMajor := strings.SplitN(serverAPIVersion, ".", 2)[0]
+	if clientMajor != serverMajor {
+		return fmt.Errorf("incompatible Bivac API version: client supports %s, server is %s", clientAPIVersion, serverAPIVersion)
+	}
+	return nil
+}
+
+// SetRetryer replaces the retry policy used for transient failures.
+func (c *Client) SetRetryer(r Retryer) {
+	c.retryer = r
+}
+
+// GetVolumes is GetVolumesContext with context.Background().
 func (c *Client) GetVolumes() (volumes []volume.Volume, err error) {
-	err = c.newRequest(&volumes, "GET", "/volumes")
+	return c.GetVolumesContext(context.Background())
+}
+
+// GetVolumesContext lists the volumes known to the remote Bivac instance.
+func (c *Client) GetVolumesContext(ctx context.Context) (volumes []volume.Volume, err error) {
+	err = c.newRequest(ctx, &volumes, "GET", "/volumes")
 	if err != nil {
 		err = fmt.Errorf("failed to connect to the remote Bivac instance: %s", err)
 		return
@@ -42,22 +103,152 @@ func (c *Client) GetVolumes() (volumes []volume.Volume, err error) {
 	return
 }
 
-func (c *Client) newRequest(data interface{}, method, endpoint string) (err error) {
-	client := &http.Client{}
-	req, err := http.NewRequest(method, c.remoteAddress+endpoint, nil)
+// StreamBackup is StreamBackupContext with context.Background().
+func (c *Client) StreamBackup(volume string, out io.Writer) error {
+	return c.StreamBackupContext(context.Background(), volume, out)
+}
+
+// StreamBackupContext triggers a backup of volume on the remote Bivac
+// instance and writes the duplicity output to out line by line as the
+// backup runs. It blocks until the backup finishes or ctx is done.
+func (c *Client) StreamBackupContext(ctx context.Context, volume string, out io.Writer) (err error) {
+	req, err := http.NewRequest("GET", c.remoteAddress+"/volumes/"+volume+"/backup/stream", nil)
 	if err != nil {
 		err = fmt.Errorf("failed to build request: %s", err)
 		return
 	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.psk))
+
+	res, err := c.httpStreamClient.Do(req)
+	if err != nil {
+		err = fmt.Errorf("failed to send request: %s", err)
+		return
+	}
+	defer res.Body.Close()
 
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		err = decodeAPIError(res.StatusCode, body)
+		return
+	}
+
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if _, err = fmt.Fprintln(out, scanner.Text()); err != nil {
+			return
+		}
+	}
+	err = scanner.Err()
+	return
+}
+
+// Events is EventsContext with context.Background().
+func (c *Client) Events(filter string) (<-chan event.Event, error) {
+	return c.EventsContext(context.Background(), filter)
+}
+
+// EventsContext streams backup lifecycle events from the remote Bivac
+// instance, filtered server-side by filter (e.g.
+// "type=backup.*,volume=pgdata", pass "" for no filtering). The returned
+// channel is closed once ctx is done or the connection ends; callers should
+// keep draining it until then.
+func (c *Client) EventsContext(ctx context.Context, filter string) (events <-chan event.Event, err error) {
+	url := c.remoteAddress + "/events"
+	if filter != "" {
+		url += "?filter=" + filter
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to build request: %s", err)
+		return
+	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.psk))
 
-	res, err := client.Do(req)
+	res, err := c.httpStreamClient.Do(req)
+	if err != nil {
+		err = fmt.Errorf("failed to send request: %s", err)
+		return
+	}
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		err = decodeAPIError(res.StatusCode, body)
+		return
+	}
+
+	ch := make(chan event.Event)
+	events = ch
+	go func() {
+		defer res.Body.Close()
+		defer close(ch)
+
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			line := strings.TrimPrefix(scanner.Text(), "data: ")
+			if line == "" {
+				continue
+			}
+			var e event.Event
+			if err := json.Unmarshal([]byte(line), &e); err != nil {
+				continue
+			}
+			select {
+			case ch <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return
+}
+
+// newRequest performs method against endpoint, decoding a JSON response
+// into data on success. Transient failures (network errors and 5xx
+// responses) are retried according to c.retryer.
+func (c *Client) newRequest(ctx context.Context, data interface{}, method, endpoint string) (err error) {
+	for attempt := 1; ; attempt++ {
+		var statusCode int
+		statusCode, err = c.doRequest(ctx, data, method, endpoint)
+		if err == nil {
+			return nil
+		}
+
+		wait, retry := c.retryer.Retry(attempt, statusCode, err)
+		if !retry {
+			return err
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// doRequest performs a single attempt of method against endpoint. statusCode
+// is 0 when the request failed before a response was received.
+func (c *Client) doRequest(ctx context.Context, data interface{}, method, endpoint string) (statusCode int, err error) {
+	req, err := http.NewRequest(method, c.remoteAddress+endpoint, nil)
+	if err != nil {
+		err = fmt.Errorf("failed to build request: %s", err)
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.psk))
+
+	res, err := c.httpClient.Do(req)
 	if err != nil {
 		err = fmt.Errorf("failed to send request: %s", err)
 		return
 	}
 	defer res.Body.Close()
+	statusCode = res.StatusCode
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
@@ -65,14 +256,26 @@ func (c *Client) newRequest(data interface{}, method, endpoint string) (err erro
 		return
 	}
 
-	if res.StatusCode == http.StatusOK {
-		if err := json.Unmarshal(body, &data); err != nil {
-			err = fmt.Errorf("failed to unmarshal response from the Bivac instance: %s", err)
-			return err
+	if statusCode == http.StatusOK {
+		if jsonErr := json.Unmarshal(body, &data); jsonErr != nil {
+			err = fmt.Errorf("failed to unmarshal response from the Bivac instance: %s", jsonErr)
 		}
-	} else {
-		err = fmt.Errorf("received wrong status code from the Bivac instance: [%d] %s", res.StatusCode, string(body))
 		return
 	}
+
+	err = decodeAPIError(statusCode, body)
 	return
 }
+
+// decodeAPIError unmarshals body into an apierror.Response so that callers
+// can use errors.Is/As against the typed errors in package apierror. If
+// body isn't a valid Response (e.g. the server predates this protocol), it
+// falls back to a plain error carrying the raw status and body.
+func decodeAPIError(status int, body []byte) error {
+	apiErr := &apierror.Response{}
+	if jsonErr := json.Unmarshal(body, apiErr); jsonErr != nil || apiErr.Code == "" {
+		return fmt.Errorf("received wrong status code from the Bivac instance: [%d] %s", status, string(body))
+	}
+	apiErr.ResponseCode = status
+	return apiErr
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestClient builds a Client talking to remoteAddress without going
+// through NewClient's /ping handshake, so tests can drive newRequest
+// directly against a test server with fine-grained control over responses.
+func newTestClient(remoteAddress string) *Client {
+	transport := &http.Transport{MaxIdleConnsPerHost: 10}
+	return &Client{
+		remoteAddress:    remoteAddress,
+		httpClient:       &http.Client{Transport: transport, Timeout: 5 * time.Second},
+		httpStreamClient: &http.Client{Transport: transport, Timeout: 0},
+		retryer:          NewExponentialBackoffRetryer(),
+	}
+}
+
+func TestNewRequestRetriesTransientFailures(t *testing.T) {
+	var attempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"type":"pong"}`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+	c.retryer = &ExponentialBackoffRetryer{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	var resp map[string]interface{}
+	if err := c.newRequest(context.Background(), &resp, "GET", "/ping"); err != nil {
+		t.Fatalf("newRequest returned error after transient failures: %s", err)
+	}
+	if attempts != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts)
+	}
+}
+
+func TestNewRequestDoesNotRetryClientErrors(t *testing.T) {
+	var attempts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"code":"volume_not_found","message":"no such volume","response_code":404}`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+
+	var resp map[string]interface{}
+	err := c.newRequest(context.Background(), &resp, "GET", "/volumes/missing")
+	if err == nil {
+		t.Fatal("expected an error for a 404 response")
+	}
+	if attempts != 1 {
+		t.Fatalf("expected exactly 1 attempt for a non-retryable status, got %d", attempts)
+	}
+}
+
+func TestNewRequestStopsOnContextCancellation(t *testing.T) {
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	c := newTestClient(srv.URL)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	var resp map[string]interface{}
+	if err := c.newRequest(ctx, &resp, "GET", "/ping"); err == nil {
+		t.Fatal("expected an error when the context is cancelled mid-request")
+	}
+}
+
+func TestClientReusesConnectionAcrossSequentialCalls(t *testing.T) {
+	var remoteAddrs []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrs = append(remoteAddrs, r.RemoteAddr)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"type":"pong"}`))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(srv.URL)
+
+	for i := 0; i < 3; i++ {
+		var resp map[string]interface{}
+		if err := c.newRequest(context.Background(), &resp, "GET", "/ping"); err != nil {
+			t.Fatalf("call %d failed: %s", i, err)
+		}
+	}
+
+	for i := 1; i < len(remoteAddrs); i++ {
+		if remoteAddrs[i] != remoteAddrs[0] {
+			t.Fatalf("expected every call to reuse the same connection, got remote addrs %v", remoteAddrs)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package client
+
+import "time"
+
+// Retryer decides whether a failed request should be retried, and how long
+// to wait before doing so. attempt is 1-indexed; statusCode is 0 when the
+// request failed before a response was received.
+type Retryer interface {
+	Retry(attempt int, statusCode int, err error) (wait time.Duration, retry bool)
+}
+
+// ExponentialBackoffRetryer retries transient failures (network errors and
+// 5xx responses) until MaxAttempts attempts have been made in all, doubling
+// BaseDelay between attempts up to MaxDelay.
+type ExponentialBackoffRetryer struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+}
+
+// NewExponentialBackoffRetryer returns an ExponentialBackoffRetryer with
+// sensible defaults: 3 attempts, starting at 200ms and capped at 5s.
+func NewExponentialBackoffRetryer() *ExponentialBackoffRetryer {
+	return &ExponentialBackoffRetryer{
+		MaxAttempts: 3,
+		BaseDelay:   200 * time.Millisecond,
+		MaxDelay:    5 * time.Second,
+	}
+}
+
+// Retry implements Retryer.
+func (r *ExponentialBackoffRetryer) Retry(attempt int, statusCode int, err error) (wait time.Duration, retry bool) {
+	if attempt >= r.MaxAttempts {
+		return 0, false
+	}
+	if statusCode != 0 && statusCode < 500 {
+		return 0, false
+	}
+	wait = r.BaseDelay * time.Duration(1<<uint(attempt-1))
+	if wait > r.MaxDelay {
+		wait = r.MaxDelay
+	}
+	return wait, true
+}
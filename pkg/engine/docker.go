@@ -0,0 +1,121 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	docker "github.com/docker/engine-api/client"
+	"github.com/docker/engine-api/types"
+	"github.com/docker/engine-api/types/container"
+)
+
+// DockerEngine runs the duplicity image through the Docker Engine API.
+type DockerEngine struct {
+	client *docker.Client
+}
+
+// NewDockerEngine returns a DockerEngine talking to the Docker daemon at
+// endpoint.
+func NewDockerEngine(endpoint string) (*DockerEngine, error) {
+	c, err := docker.NewClient(endpoint, "", nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Docker client: %s", err)
+	}
+	return &DockerEngine{client: c}, nil
+}
+
+// Pull pulls image unless it is already present locally.
+func (e *DockerEngine) Pull(ctx context.Context, image string) (err error) {
+	if _, _, err = e.client.ImageInspectWithRaw(ctx, image, false); err == nil {
+		return nil
+	}
+	body, err := e.client.ImagePull(ctx, image, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	// The pull only completes once its progress stream has been read.
+	_, err = io.Copy(ioutil.Discard, body)
+	return
+}
+
+// Run creates, starts and waits for a container running spec, returning its
+// exit code and combined output.
+func (e *DockerEngine) Run(ctx context.Context, spec RunSpec) (exitCode int, logs io.ReadCloser, err error) {
+	cont, err := e.client.ContainerCreate(
+		ctx,
+		&container.Config{
+			Cmd:          spec.Cmd,
+			Env:          spec.Env,
+			Image:        spec.Image,
+			OpenStdin:    true,
+			StdinOnce:    true,
+			AttachStdin:  true,
+			AttachStdout: true,
+			AttachStderr: true,
+			Tty:          true,
+		},
+		&container.HostConfig{Binds: spec.Binds}, nil, "",
+	)
+	if err != nil {
+		err = fmt.Errorf("failed to create container: %s", err)
+		return
+	}
+	defer e.client.ContainerRemove(ctx, cont.ID, types.ContainerRemoveOptions{
+		Force:         true,
+		RemoveVolumes: true,
+		RemoveLinks:   true,
+	})
+
+	if err = e.client.ContainerStart(ctx, cont.ID, types.ContainerStartOptions{}); err != nil {
+		err = fmt.Errorf("failed to start container: %s", err)
+		return
+	}
+
+	body, err := e.client.ContainerLogs(ctx, cont.ID, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Details:    true,
+		Follow:     true,
+	})
+	if err != nil {
+		err = fmt.Errorf("failed to retrieve logs: %s", err)
+		return
+	}
+	defer body.Close()
+
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+	if spec.Output != nil {
+		out = io.MultiWriter(&buf, spec.Output)
+	}
+	flusher, _ := spec.Output.(http.Flusher)
+
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		fmt.Fprintln(out, scanner.Text())
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		err = fmt.Errorf("failed to read logs from response: %s", err)
+		return
+	}
+	logs = ioutil.NopCloser(bytes.NewReader(buf.Bytes()))
+
+	info, err := e.client.ContainerInspect(ctx, cont.ID)
+	if err != nil {
+		err = fmt.Errorf("failed to inspect container: %s", err)
+		return
+	}
+	exitCode = info.State.ExitCode
+
+	return
+}
@@ -0,0 +1,50 @@
+// Package engine abstracts the container runtime Bivac uses to run the
+// duplicity image, so that backups can be launched without requiring a
+// Docker daemon.
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// RunSpec describes a single invocation of the duplicity image against an
+// Engine.
+type RunSpec struct {
+	Image string
+	Cmd   []string
+	Env   []string
+	Binds []string
+	// Output, if set, receives a live copy of the container's combined
+	// stdout/stderr as Run produces it, in addition to the buffered logs
+	// Run returns. If Output implements http.Flusher, DockerEngine.Run
+	// flushes it after each line so callers can stream the backup live;
+	// RuncEngine.Run writes to it as buildah produces output and does not
+	// flush it.
+	Output io.Writer
+}
+
+// Engine runs the duplicity image to perform a backup, verify or prune.
+type Engine interface {
+	// Pull ensures image is present locally.
+	Pull(ctx context.Context, image string) error
+	// Run runs a container for spec to completion and returns its exit
+	// code together with its combined stdout/stderr.
+	Run(ctx context.Context, spec RunSpec) (exitCode int, logs io.ReadCloser, err error)
+}
+
+// New returns the Engine backend named by kind: "docker" runs containers
+// through the Docker Engine API and requires dockerEndpoint; "runc" (and
+// its alias "podman") runs them rootlessly through buildah/runc and does
+// not. An empty kind defaults to "docker".
+func New(kind string, dockerEndpoint string) (Engine, error) {
+	switch kind {
+	case "", "docker":
+		return NewDockerEngine(dockerEndpoint)
+	case "podman", "runc":
+		return NewRuncEngine(), nil
+	default:
+		return nil, fmt.Errorf("unknown engine %q", kind)
+	}
+}
@@ -0,0 +1,78 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+)
+
+// RuncEngine runs the duplicity image rootlessly through buildah/runc,
+// without requiring a Docker daemon. It targets environments such as
+// Kubernetes with containerd, OpenShift or hardened hosts where
+// /var/run/docker.sock is unavailable.
+type RuncEngine struct{}
+
+// NewRuncEngine returns a RuncEngine.
+func NewRuncEngine() *RuncEngine {
+	return &RuncEngine{}
+}
+
+// Pull pulls image into local containers/storage via buildah.
+func (e *RuncEngine) Pull(ctx context.Context, image string) error {
+	out, err := exec.CommandContext(ctx, "buildah", "pull", image).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to pull image with buildah: %s: %s", err, out)
+	}
+	return nil
+}
+
+// Run runs spec to completion with "buildah run", returning its exit code
+// and combined output. "buildah run" only operates on an already-instantiated
+// working container, so Run first materializes one from spec.Image with
+// "buildah from" (binding volumes at that step), and removes it again once
+// the command finishes.
+func (e *RuncEngine) Run(ctx context.Context, spec RunSpec) (exitCode int, logs io.ReadCloser, err error) {
+	fromArgs := []string{"from"}
+	for _, bind := range spec.Binds {
+		fromArgs = append(fromArgs, "--volume", bind)
+	}
+	fromArgs = append(fromArgs, spec.Image)
+
+	fromOut, err := exec.CommandContext(ctx, "buildah", fromArgs...).Output()
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to create working container with buildah: %s", err)
+	}
+	container := strings.TrimSpace(string(fromOut))
+	defer exec.Command("buildah", "rm", container).Run()
+
+	args := []string{"run"}
+	for _, env := range spec.Env {
+		args = append(args, "--env", env)
+	}
+	args = append(args, container)
+	args = append(args, spec.Cmd...)
+
+	cmd := exec.CommandContext(ctx, "buildah", args...)
+	var buf bytes.Buffer
+	var out io.Writer = &buf
+	if spec.Output != nil {
+		out = io.MultiWriter(&buf, spec.Output)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	runErr := cmd.Run()
+	logs = ioutil.NopCloser(bytes.NewReader(buf.Bytes()))
+
+	if runErr == nil {
+		return 0, logs, nil
+	}
+	if exitErr, ok := runErr.(*exec.ExitError); ok {
+		return exitErr.ExitCode(), logs, nil
+	}
+	return 0, logs, fmt.Errorf("failed to run buildah: %s", runErr)
+}
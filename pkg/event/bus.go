@@ -0,0 +1,50 @@
+package event
+
+import "sync"
+
+// Bus is a small in-process publish/subscribe bus for Events.
+type Bus struct {
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+// NewBus returns a ready-to-use Bus.
+func NewBus() *Bus {
+	return &Bus{subscribers: make(map[chan Event]struct{})}
+}
+
+// Subscribe registers a new subscriber and returns a channel that receives
+// the Events published after the call, until Unsubscribe is called. The
+// channel buffers 16 Events; Events published while it is full are dropped
+// for this subscriber (see Publish).
+func (b *Bus) Subscribe() chan Event {
+	ch := make(chan Event, 16)
+	b.mu.Lock()
+	b.subscribers[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+// Unsubscribe removes a subscriber previously returned by Subscribe and
+// closes its channel.
+func (b *Bus) Unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Publish fans e out to every current subscriber. A subscriber whose buffer
+// is full is skipped rather than blocking the publisher.
+func (b *Bus) Publish(e Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
@@ -0,0 +1,30 @@
+// Package event defines the backup lifecycle events published by Bivac and
+// a small in-process bus to fan them out to subscribers.
+package event
+
+import "time"
+
+// Type identifies the kind of lifecycle event being published.
+type Type string
+
+// Event types. The handler package publishes the backup.* types as backups
+// run; nothing in this repository publishes verify.finished or
+// prune.finished.
+const (
+	TypeBackupStarted  Type = "backup.started"
+	TypeBackupFinished Type = "backup.finished"
+	TypeBackupFailed   Type = "backup.failed"
+	TypeVerifyFinished Type = "verify.finished"
+	TypePruneFinished  Type = "prune.finished"
+)
+
+// Event describes a single backup lifecycle occurrence.
+type Event struct {
+	Type     Type          `json:"type"`
+	Volume   string        `json:"volume"`
+	Hostname string        `json:"hostname"`
+	ExitCode int           `json:"exit_code"`
+	Duration time.Duration `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+	Time     time.Time     `json:"time"`
+}
@@ -0,0 +1,87 @@
+// Package idle tracks in-flight work (HTTP requests, running backups) so
+// that a bivac server can shut itself down once idle for a configurable
+// duration, similar to podman's pkg/api/server/idle tracker.
+package idle
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Tracker counts units of in-flight work and calls onIdle once none have
+// been active for Timeout.
+type Tracker struct {
+	// Timeout is how long the tracker must see no active work before
+	// calling onIdle. A zero Timeout disables idle shutdown.
+	Timeout time.Duration
+
+	mu     sync.Mutex
+	active int64
+	timer  *time.Timer
+	onIdle func()
+}
+
+// NewTracker returns a Tracker that calls onIdle once no requests or
+// backups have been active for timeout. A zero timeout disables idle
+// shutdown.
+func NewTracker(timeout time.Duration, onIdle func()) *Tracker {
+	t := &Tracker{Timeout: timeout, onIdle: onIdle}
+	t.mu.Lock()
+	t.armTimerLocked()
+	t.mu.Unlock()
+	return t
+}
+
+// Handler wraps next with in-flight request accounting.
+func (t *Tracker) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Add()
+		defer t.Done()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Add marks one more unit of work (an HTTP request or a running backup) as
+// active, cancelling any pending idle shutdown.
+func (t *Tracker) Add() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.active++
+	t.stopTimerLocked()
+}
+
+// Done marks a unit of work as finished, (re)arming the idle timer once
+// nothing else is active.
+func (t *Tracker) Done() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.active > 0 {
+		t.active--
+	}
+	if t.active == 0 {
+		t.armTimerLocked()
+	}
+}
+
+// ActiveCount returns the number of currently in-flight requests/backups.
+func (t *Tracker) ActiveCount() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.active
+}
+
+func (t *Tracker) armTimerLocked() {
+	t.stopTimerLocked()
+	if t.Timeout <= 0 || t.onIdle == nil {
+		return
+	}
+	t.timer = time.AfterFunc(t.Timeout, t.onIdle)
+}
+
+func (t *Tracker) stopTimerLocked() {
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/camptocamp/bivac/pkg/apierror"
+)
+
+// writeJSON writes v to w as a JSON body, logging (but not failing the
+// response on) encoding errors.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Failed to write JSON response")
+	}
+}
+
+// writeAPIError writes an apierror.Response envelope to w with the given
+// HTTP status code, so that clients can unmarshal it into a typed error.
+func writeAPIError(w http.ResponseWriter, status int, code, message string, cause error) {
+	resp := apierror.NewResponse(status, code, message).WithCause(cause)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Failed to write error response")
+	}
+}
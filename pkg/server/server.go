@@ -0,0 +1,287 @@
+// Package server exposes a handler.Conplicity instance over HTTP so that
+// remote bivac clients (see pkg/client) can trigger and follow backups
+// without local access to the Docker daemon.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/camptocamp/bivac/handler"
+	"github.com/camptocamp/bivac/pkg/apierror"
+	"github.com/camptocamp/bivac/pkg/event"
+	"github.com/camptocamp/bivac/pkg/idle"
+)
+
+// APIVersion is the Bivac client/server protocol version served at /ping.
+// Clients reject servers whose major component doesn't match their own, so
+// that incompatible protocol changes can be rolled out safely.
+const APIVersion = "1.2"
+
+// Server serves the Bivac HTTP API for a single Conplicity instance.
+type Server struct {
+	Conplicity *handler.Conplicity
+	Version    string
+	// PSK, when non-empty, is compared against the bearer token on every
+	// request except /ping; a missing or mismatched token gets
+	// apierror.ErrUnauthorized. An empty PSK disables authentication.
+	PSK string
+
+	idle       *idle.Tracker
+	httpServer *http.Server
+
+	backupsMu sync.Mutex
+	backups   map[string]bool
+}
+
+// NewServer returns a Server wrapping c, authenticating requests against
+// psk (pass "" to disable authentication) and reporting version as its
+// server_version at /ping. If c.Config.Server.IdleTimeout is set, the
+// server shuts itself down once no requests or backups have been active
+// for that duration; c.Idle is set so that LaunchDuplicity calls driven
+// outside of an HTTP request (e.g. by a scheduler running in the same
+// process) also count as active work. /ping itself is never counted as
+// activity (see Handler), so a liveness/readiness probe hitting it on any
+// interval can't prevent the server from reaching idle.
+func NewServer(c *handler.Conplicity, psk string, version string) (*Server, error) {
+	var idleTimeout time.Duration
+	if raw := c.Config.Server.IdleTimeout; raw != "" {
+		var err error
+		if idleTimeout, err = time.ParseDuration(raw); err != nil {
+			return nil, fmt.Errorf("invalid idle-timeout %q: %s", raw, err)
+		}
+	}
+
+	s := &Server{Conplicity: c, Version: version, PSK: psk, backups: make(map[string]bool)}
+	s.idle = idle.NewTracker(idleTimeout, s.shutdownOnIdle)
+	c.Idle = s.idle
+	return s, nil
+}
+
+// Handler builds the HTTP handler serving the Bivac API. /ping is served
+// outside of both authentication and the idle tracker: it carries no
+// secrets, and a liveness/readiness probe hitting it periodically would
+// otherwise keep resetting the idle timer and the server would never shut
+// down.
+func (s *Server) Handler() http.Handler {
+	tracked := http.NewServeMux()
+	tracked.HandleFunc("/volumes/", s.handleVolumes)
+	tracked.HandleFunc("/events", s.handleEvents)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", s.handlePing)
+	mux.Handle("/volumes/", s.idle.Handler(s.authenticate(tracked)))
+	mux.Handle("/events", s.idle.Handler(s.authenticate(tracked)))
+	return mux
+}
+
+// authenticate rejects requests whose "Authorization: Bearer <token>"
+// header doesn't match s.PSK. It is a no-op when s.PSK is empty.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.PSK == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer "+s.PSK {
+			writeAPIError(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "invalid or missing bearer token", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// startBackup marks volumeName as having a backup in progress, returning
+// false if one was already running.
+func (s *Server) startBackup(volumeName string) bool {
+	s.backupsMu.Lock()
+	defer s.backupsMu.Unlock()
+	if s.backups[volumeName] {
+		return false
+	}
+	s.backups[volumeName] = true
+	return true
+}
+
+// finishBackup marks volumeName as no longer having a backup in progress.
+func (s *Server) finishBackup(volumeName string) {
+	s.backupsMu.Lock()
+	defer s.backupsMu.Unlock()
+	delete(s.backups, volumeName)
+}
+
+// ListenAndServe starts the HTTP server on addr and blocks until it exits,
+// either because of an error or because the server shut itself down once
+// idle.
+func (s *Server) ListenAndServe(addr string) error {
+	s.httpServer = &http.Server{Addr: addr, Handler: s.Handler()}
+	err := s.httpServer.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) shutdownOnIdle() {
+	log.Info("Server idle, shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		log.WithFields(log.Fields{"err": err}).Error("Failed to shut down idle server")
+	}
+}
+
+func (s *Server) handlePing(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"type":           "pong",
+		"active":         s.idle.ActiveCount(),
+		"api_version":    APIVersion,
+		"server_version": s.Version,
+	})
+}
+
+// handleVolumes dispatches requests under /volumes/.
+func (s *Server) handleVolumes(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/backup/stream") {
+		s.handleBackupStream(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// handleBackupStream serves GET /volumes/{name}/backup/stream: it launches a
+// backup of the named volume through LaunchDuplicity and streams the
+// duplicity output back to the client line by line as it runs, so
+// long-running backups don't appear hung. Routing through LaunchDuplicity
+// (rather than driving the backend directly) means the backup publishes the
+// same lifecycle Events and honours the same Config.Engine selection as a
+// scheduled backup does. Output is flushed line by line only with the
+// "docker" engine; the "runc"/"podman" engine writes it without flushing
+// (see engine.RunSpec.Output).
+func (s *Server) handleBackupStream(w http.ResponseWriter, r *http.Request) {
+	volumeName := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/volumes/"), "/backup/stream")
+	if volumeName == "" {
+		writeAPIError(w, http.StatusNotFound, apierror.CodeVolumeNotFound, "volume not specified", nil)
+		return
+	}
+
+	if !s.startBackup(volumeName) {
+		writeAPIError(w, http.StatusConflict, apierror.CodeBackupInProgress, fmt.Sprintf("a backup of volume %q is already in progress", volumeName), nil)
+		return
+	}
+	defer s.finishBackup(volumeName)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeAPIError(w, http.StatusInternalServerError, apierror.CodeInternal, "streaming unsupported", nil)
+		return
+	}
+
+	cmd, binds := s.Conplicity.BackupCommand(volumeName)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Transfer-Encoding", "chunked")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	if _, _, err := s.Conplicity.LaunchDuplicity(volumeName, cmd, binds, w); err != nil {
+		log.WithFields(log.Fields{
+			"volume": volumeName,
+			"err":    err,
+		}).Error("Failed to run streamed backup")
+	}
+}
+
+// handleEvents serves GET /events, streaming backup lifecycle Events as they
+// are published on s.Conplicity.Events. Events are rendered as
+// Server-Sent Events when the client sends "Accept: text/event-stream", and
+// as newline-delimited JSON otherwise. The optional "filter" query parameter
+// restricts which events are sent, e.g. "filter=type=backup.*,volume=pgdata".
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	filters := parseEventFilters(r.URL.Query().Get("filter"))
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	ch := s.Conplicity.Events.Subscribe()
+	defer s.Conplicity.Events.Unsubscribe(ch)
+
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !filters.match(e) {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if sse {
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			} else {
+				fmt.Fprintf(w, "%s\n", data)
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// eventFilters holds the parsed key/value pairs of a "filter" query
+// parameter.
+type eventFilters map[string]string
+
+// parseEventFilters parses a "key=value,key=value" filter grammar, e.g.
+// "type=backup.*,volume=pgdata".
+func parseEventFilters(raw string) eventFilters {
+	f := eventFilters{}
+	if raw == "" {
+		return f
+	}
+	for _, pair := range strings.Split(raw, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		f[kv[0]] = kv[1]
+	}
+	return f
+}
+
+// match reports whether e satisfies every filter in f. The "type" filter
+// supports shell-style globs (e.g. "backup.*").
+func (f eventFilters) match(e event.Event) bool {
+	if want, ok := f["type"]; ok {
+		if matched, _ := path.Match(want, string(e.Type)); !matched {
+			return false
+		}
+	}
+	if want, ok := f["volume"]; ok && want != e.Volume {
+		return false
+	}
+	return true
+}